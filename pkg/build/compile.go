@@ -18,8 +18,6 @@ import (
 	"context"
 	"fmt"
 	"maps"
-	"os"
-	"path/filepath"
 
 	"chainguard.dev/melange/pkg/cond"
 	"chainguard.dev/melange/pkg/config"
@@ -30,6 +28,8 @@ import (
 )
 
 func (t *Test) Compile(ctx context.Context) error {
+	ctx, locks := withPipelineLocks(ctx)
+
 	cfg := t.Configuration
 
 	// TODO: Make this parameter go away when we revisit subtitutions.
@@ -99,17 +99,35 @@ func (t *Test) Compile(ctx context.Context) error {
 	// Append anything the main package test needs.
 	te.Packages = append(te.Packages, c.Needs...)
 
+	if err := locks.save(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // Compile compiles all configuration, including tests, by loading any pipelines and substituting all variables.
 func (b *Build) Compile(ctx context.Context) error {
+	return b.compile(ctx, nil)
+}
+
+// compile does the work of Compile, plus extra substitutions layered on
+// top of the ones NewSubstitutionMap derives from the configuration
+// itself. Workspace uses this to bind the `workspace.*` namespace into
+// each member's SubstitutionMap before compiling it.
+func (b *Build) compile(ctx context.Context, extra map[string]string) error {
+	ctx, locks := withPipelineLocks(ctx)
+
 	cfg := b.Configuration
 	sm, err := NewSubstitutionMap(&cfg, b.Arch, b.BuildFlavor(), b.EnabledBuildOptions)
 	if err != nil {
 		return err
 	}
 
+	for k, v := range extra {
+		sm.Substitutions[k] = v
+	}
+
 	c := &Compiled{
 		PipelineDirs: b.PipelineDirs,
 	}
@@ -173,70 +191,152 @@ func (b *Build) Compile(ctx context.Context) error {
 
 	b.externalRefs = c.ExternalRefs
 
+	if err := locks.save(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 type Compiled struct {
 	PipelineDirs []string
 
+	// Resolvers overrides the default chain of PipelineResolvers tried
+	// for each unversioned `uses:` reference (local PipelineDirs, the embedded
+	// pipelines/ tree, then OCI, git, and HTTPS). Nil uses the default
+	// chain built from PipelineDirs.
+	Resolvers []PipelineResolver
+
+	// MaxNeedsIterations bounds the needs.packages fixed-point loop in
+	// CompilePipelines. Zero or negative uses defaultMaxNeedsIterations.
+	MaxNeedsIterations int
+
 	Needs        []string
 	ExternalRefs []purl.PackageURL
 }
 
+// maxNeedsIterations returns the configured iteration cap for the
+// needs.packages fixed-point loop, or defaultMaxNeedsIterations if the
+// caller didn't set one.
+func (c *Compiled) maxNeedsIterations() int {
+	if c.MaxNeedsIterations > 0 {
+		return c.MaxNeedsIterations
+	}
+	return defaultMaxNeedsIterations
+}
+
+// CompilePipelines compiles pipelines to a fixed point over their
+// cumulative needs.packages, the same way the Go module loader iterates
+// module graph loading until the build list stops changing. Each
+// iteration recompiles the whole list from scratch with the needs
+// gathered by the previous iteration bound into sm under a `needs.*`
+// namespace, so a pipeline's `if:` can react to what an earlier one in
+// the same list pulled in (e.g. `if: ${{needs.has.foo}}=='true'`). This
+// repeats until the needs set is the same as in the previous iteration,
+// a set seen in an earlier iteration comes back (an oscillation), or
+// maxNeedsIterations is exceeded.
 func (c *Compiled) CompilePipelines(ctx context.Context, sm *SubstitutionMap, pipelines []config.Pipeline) error {
-	for i := range pipelines {
-		if err := c.compilePipeline(ctx, sm, &pipelines[i]); err != nil {
-			return fmt.Errorf("compiling Pipeline[%d]: %w", i, err)
+	log := clog.FromContext(ctx)
+
+	var (
+		needs []string
+		seen  = map[string]bool{}
+	)
+
+	maxIter := c.maxNeedsIterations()
+
+	for iter := 0; ; iter++ {
+		if iter >= maxIter {
+			return fmt.Errorf("needs.packages did not converge after %d iterations", maxIter)
 		}
 
-		if err := c.gatherDeps(ctx, &pipelines[i]); err != nil {
-			return fmt.Errorf("gathering deps for Pipeline[%d]: %w", i, err)
+		work, err := clonePipelines(pipelines)
+		if err != nil {
+			return err
 		}
-	}
 
-	return nil
+		iterSM := sm.withNeeds(needs)
+		iterC := &Compiled{PipelineDirs: c.PipelineDirs, Resolvers: c.Resolvers, MaxNeedsIterations: c.MaxNeedsIterations}
+
+		refs, err := iterC.compileSiblings(ctx, iterSM, work, 0, nil)
+		if err != nil {
+			return err
+		}
+		iterC.ExternalRefs = append(iterC.ExternalRefs, refs...)
+
+		// gatherDeps runs after the parallel phase, in order, so
+		// iterC.Needs stays deterministic regardless of how the
+		// goroutines above were scheduled.
+		for i := range work {
+			if err := iterC.gatherDeps(ctx, &work[i]); err != nil {
+				return fmt.Errorf("gathering deps for Pipeline[%d]: %w", i, err)
+			}
+		}
+
+		hash := hashNeeds(iterC.Needs)
+		if hash == hashNeeds(needs) {
+			copy(pipelines, work)
+			c.Needs = append(c.Needs, iterC.Needs...)
+			c.ExternalRefs = append(c.ExternalRefs, iterC.ExternalRefs...)
+			return nil
+		}
+
+		if seen[hash] {
+			return fmt.Errorf("needs.packages oscillated instead of converging after %d iterations (last seen: %v)", iter+1, iterC.Needs)
+		}
+		seen[hash] = true
+
+		log.Debugf("needs.packages iteration %d: %v", iter, iterC.Needs)
+		needs = iterC.Needs
+	}
 }
 
-func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pipeline *config.Pipeline) error {
+// compilePipeline compiles a single pipeline node, including its nested
+// pipeline.Pipeline children, and returns the ExternalRefs gathered from
+// it and all of its descendants. It never touches c.ExternalRefs
+// directly: compilePipeline runs concurrently with its siblings (see
+// compileSiblings), so the caller collects each return value into a
+// pre-sized slot and flattens them in order once every sibling is done.
+func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pipeline *config.Pipeline) ([]purl.PackageURL, error) {
 	log := clog.FromContext(ctx)
+	progress := progressFromContext(ctx)
+	depth := depthFromContext(ctx)
+	id := identity(pipeline)
+
+	progress.OnPipelineStart(id, depth)
+	defer progress.OnPipelineFinish(id, depth)
+
 	uses, with := pipeline.Uses, maps.Clone(pipeline.With)
 
+	// resolvedVersion is non-empty when uses carries a semver constraint
+	// (e.g. "fetch@^1.2.0"); remoteRef is set when uses was satisfied by
+	// a remote PipelineResolver (OCI, git, or HTTPS). Both are threaded
+	// into the pipeline's external refs below so SBOMs record exactly
+	// what was used.
+	var (
+		resolvedVersion string
+		remoteRef       *ResolvedRef
+	)
 	if uses != "" {
-		var data []byte
-		// Set this to fail up front in case there are no pipeline dirs specified
-		// and we can't find them.
-		err := fmt.Errorf("could not find 'uses' pipeline %q", uses)
-
-		for _, pd := range c.PipelineDirs {
-			log.Debugf("trying to load pipeline %q from %q", uses, pd)
-
-			data, err = os.ReadFile(filepath.Join(pd, uses+".yaml"))
-			if err == nil {
-				log.Infof("Found pipeline %s", string(data))
-				break
-			}
-		}
+		data, version, resolved, err := c.resolvePipeline(ctx, uses)
 		if err != nil {
-			log.Debugf("trying to load pipeline %q from embedded fs pipelines/%q.yaml", uses, uses)
-			data, err = f.ReadFile("pipelines/" + uses + ".yaml")
-			if err != nil {
-				return fmt.Errorf("unable to load pipeline: %w", err)
-			}
+			return nil, fmt.Errorf("unable to load pipeline: %w", err)
 		}
+		resolvedVersion, remoteRef = version, resolved
 
 		if err := yaml.Unmarshal(data, pipeline); err != nil {
-			return fmt.Errorf("unable to parse pipeline %q: %w", uses, err)
+			return nil, fmt.Errorf("unable to parse pipeline %q: %w", uses, err)
 		}
 	}
 
 	validated, err := validateWith(with, pipeline.Inputs)
 	if err != nil {
-		return fmt.Errorf("unable to validate with: %w", err)
+		return nil, fmt.Errorf("unable to validate with: %w", err)
 	}
 
 	mutated, err := sm.MutateWith(validated)
 	if err != nil {
-		return fmt.Errorf("mutating with: %w", err)
+		return nil, fmt.Errorf("mutating with: %w", err)
 	}
 
 	// allow input mutations on needs.packages
@@ -244,7 +344,7 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 		for i := range pipeline.Needs.Packages {
 			pipeline.Needs.Packages[i], err = util.MutateStringFromMap(mutated, pipeline.Needs.Packages[i])
 			if err != nil {
-				return fmt.Errorf("mutating needs: %w", err)
+				return nil, fmt.Errorf("mutating needs: %w", err)
 			}
 		}
 	}
@@ -252,38 +352,56 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 	if pipeline.WorkDir != "" {
 		pipeline.WorkDir, err = util.MutateStringFromMap(mutated, pipeline.WorkDir)
 		if err != nil {
-			return fmt.Errorf("mutating workdir: %w", err)
+			return nil, fmt.Errorf("mutating workdir: %w", err)
 		}
 	}
 
 	pipeline.Runs, err = util.MutateStringFromMap(mutated, pipeline.Runs)
 	if err != nil {
-		return fmt.Errorf("mutating runs: %w", err)
+		return nil, fmt.Errorf("mutating runs: %w", err)
 	}
 
 	if pipeline.If != "" {
 		pipeline.If, err = util.MutateAndQuoteStringFromMap(mutated, pipeline.If)
 		if err != nil {
-			return fmt.Errorf("mutating if: %w", err)
+			return nil, fmt.Errorf("mutating if: %w", err)
 		}
 	}
 
-	// Compute external refs for this pipeline.
-	externalRefs, err := computeExternalRefs(uses, mutated)
-	if err != nil {
-		return fmt.Errorf("computing external refs: %w", err)
-	}
+	// Compute external refs for this pipeline. A remote uses (OCI, git, or
+	// HTTPS) skips computeExternalRefs entirely: for OCI and git,
+	// remoteRef.PURL below is already a precise purl for it, and running
+	// computeExternalRefs on the raw "oci://...#path" / "git+...@rev#path"
+	// string as well would just produce a second, garbled entry alongside
+	// the correct one. An HTTPS uses has no PURL and records no external
+	// ref.
+	var externalRefs []purl.PackageURL
+	if remoteRef == nil {
+		externalRefs, err = computeExternalRefs(refForExternalRefs(uses, resolvedVersion), mutated)
+		if err != nil {
+			return nil, fmt.Errorf("computing external refs: %w", err)
+		}
 
-	c.ExternalRefs = append(c.ExternalRefs, externalRefs...)
+		if resolvedVersion != "" {
+			for i := range externalRefs {
+				externalRefs[i].Version = resolvedVersion
+			}
+		}
+	} else if remoteRef.PURL != "" {
+		if p, err := purl.FromString(remoteRef.PURL); err != nil {
+			log.Warnf("parsing resolved purl %q for pipeline %q: %v", remoteRef.PURL, uses, err)
+		} else {
+			externalRefs = append(externalRefs, p)
+		}
+	}
 
-	for i := range pipeline.Pipeline {
-		p := &pipeline.Pipeline[i]
+	childRefs, err := c.compileSiblings(ctx, sm, pipeline.Pipeline, depth+1, func(p *config.Pipeline) {
 		p.With = util.RightJoinMap(mutated, p.With)
-
-		if err := c.compilePipeline(ctx, sm, p); err != nil {
-			return fmt.Errorf("compiling Pipeline[%d]: %w", i, err)
-		}
+	})
+	if err != nil {
+		return nil, err
 	}
+	externalRefs = append(externalRefs, childRefs...)
 
 	// We only want to include "with"s that have non-default values.
 	defaults := map[string]string{}
@@ -304,7 +422,7 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 	// We don't care about the documented inputs.
 	pipeline.Inputs = nil
 
-	return nil
+	return externalRefs, nil
 }
 
 func identity(p *config.Pipeline) string {
@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+)
+
+type pipelineLocksContextKey struct{}
+
+// pipelineLocks bundles the two pipeline lockfiles a Compile call needs:
+// the semver pin (pipelineLockFile) and the remote digest pin
+// (remotePipelineLockFile).
+type pipelineLocks struct {
+	version *diskLock
+	remote  *diskLock
+}
+
+func newPipelineLocks() *pipelineLocks {
+	return &pipelineLocks{
+		version: loadDiskLock(pipelineLockFile),
+		remote:  loadDiskLock(remotePipelineLockFile),
+	}
+}
+
+// save persists both lockfiles, if they changed since they were loaded.
+func (l *pipelineLocks) save() error {
+	if err := l.version.save(pipelineLockFile); err != nil {
+		return fmt.Errorf("saving pipeline lock: %w", err)
+	}
+	if err := l.remote.save(remotePipelineLockFile); err != nil {
+		return fmt.Errorf("saving remote pipeline lock: %w", err)
+	}
+	return nil
+}
+
+// withPipelineLocks returns ctx with a *pipelineLocks attached, reusing
+// one already present (e.g. a Workspace sharing a single set of locks
+// across its members) rather than loading a new one. Build.Compile and
+// Test.Compile call this once, at the top of each invocation: every
+// nested Compiled they construct shares that instance via ctx, but two
+// separate top-level Compile calls in the same process - two Builds for
+// different packages, say - each get their own, loaded fresh from
+// whatever's on disk for that call. That's what keeps the lockfiles a
+// stable, per-invocation pin instead of a process-wide cache that lets
+// whichever Build resolves last clobber another's entries.
+func withPipelineLocks(ctx context.Context) (context.Context, *pipelineLocks) {
+	if l, ok := ctx.Value(pipelineLocksContextKey{}).(*pipelineLocks); ok {
+		return ctx, l
+	}
+	l := newPipelineLocks()
+	return context.WithValue(ctx, pipelineLocksContextKey{}, l), l
+}
+
+// pipelineLocksFromContext returns the *pipelineLocks attached to ctx by
+// withPipelineLocks, or a freshly loaded one if none is present, so
+// resolveVersioned/resolveChain work even when called without going
+// through Build.Compile/Test.Compile/Workspace.Compile first.
+func pipelineLocksFromContext(ctx context.Context) *pipelineLocks {
+	if l, ok := ctx.Value(pipelineLocksContextKey{}).(*pipelineLocks); ok {
+		return l
+	}
+	return newPipelineLocks()
+}
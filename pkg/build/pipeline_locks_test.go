@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"testing"
+)
+
+// Two independent top-level Compile calls must not share a *pipelineLocks:
+// otherwise a pin resolved while compiling one package could leak into, or
+// be clobbered by, a pin resolved while compiling an unrelated one in the
+// same process.
+func TestWithPipelineLocksIsolatesUnrelatedCalls(t *testing.T) {
+	_, a := withPipelineLocks(context.Background())
+	_, b := withPipelineLocks(context.Background())
+
+	if a == b {
+		t.Fatal("withPipelineLocks returned the same *pipelineLocks for two unrelated contexts")
+	}
+
+	a.version.set("fetch@^1.0.0", "1.2.0")
+	if _, ok := b.version.get("fetch@^1.0.0"); ok {
+		t.Fatal("a pin set on one call's locks leaked into another's")
+	}
+}
+
+// A Workspace shares one set of locks across its members by attaching
+// them to ctx once, up front: every nested withPipelineLocks call for
+// that same ctx (or a descendant of it) must return the identical
+// instance rather than loading its own.
+func TestWithPipelineLocksReusesAttachedInstance(t *testing.T) {
+	ctx, want := withPipelineLocks(context.Background())
+
+	ctx = context.WithValue(ctx, struct{ unrelated string }{"k"}, "v")
+
+	_, got := withPipelineLocks(ctx)
+	if got != want {
+		t.Fatal("withPipelineLocks loaded a new instance instead of reusing the one already attached to ctx")
+	}
+}
+
+func TestPipelineLocksFromContextFallsBackWhenAbsent(t *testing.T) {
+	l := pipelineLocksFromContext(context.Background())
+	if l == nil {
+		t.Fatal("pipelineLocksFromContext returned nil for a context with no locks attached")
+	}
+}
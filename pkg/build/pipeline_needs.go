@@ -0,0 +1,97 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMaxNeedsIterations bounds the fixed-point loop in
+// CompilePipelines when the caller doesn't set Compiled.MaxNeedsIterations.
+const defaultMaxNeedsIterations = 10
+
+// clonePipelines returns a deep copy of pipelines via a YAML round-trip,
+// so each needs.packages iteration can compile from a pristine copy
+// without earlier mutations (resolved `uses:`, quoted `if:`, cleared
+// Inputs) from a discarded iteration bleeding into the next one.
+func clonePipelines(pipelines []config.Pipeline) ([]config.Pipeline, error) {
+	data, err := yaml.Marshal(pipelines)
+	if err != nil {
+		return nil, fmt.Errorf("cloning pipelines: %w", err)
+	}
+
+	var clone []config.Pipeline
+	if err := yaml.Unmarshal(data, &clone); err != nil {
+		return nil, fmt.Errorf("cloning pipelines: %w", err)
+	}
+
+	return clone, nil
+}
+
+// hashNeeds summarizes a needs.packages set for fixed-point and cycle
+// detection: the same set, regardless of order or duplicate entries,
+// always hashes the same.
+func hashNeeds(needs []string) string {
+	sorted := append([]string(nil), needs...)
+	sort.Strings(sorted)
+
+	uniq := sorted[:0]
+	for _, n := range sorted {
+		if len(uniq) == 0 || n != uniq[len(uniq)-1] {
+			uniq = append(uniq, n)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(uniq, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// withNeeds returns a copy of sm with the `needs.*` substitution
+// namespace bound to the given needs.packages set, so a pipeline's
+// `if:` can react to what an earlier pipeline in the same
+// CompilePipelines call pulled in. ${{needs.packages}} is the sorted,
+// space-joined set; ${{needs.has.<pkg>}} is "true" for each package in
+// it.
+func (sm *SubstitutionMap) withNeeds(needs []string) *SubstitutionMap {
+	clone := *sm
+	clone.Substitutions = maps.Clone(sm.Substitutions)
+	if clone.Substitutions == nil {
+		clone.Substitutions = map[string]string{}
+	}
+
+	for k := range clone.Substitutions {
+		if strings.HasPrefix(k, "${{needs.") {
+			delete(clone.Substitutions, k)
+		}
+	}
+
+	sorted := append([]string(nil), needs...)
+	sort.Strings(sorted)
+
+	clone.Substitutions["${{needs.packages}}"] = strings.Join(sorted, " ")
+	for _, n := range sorted {
+		clone.Substitutions[fmt.Sprintf("${{needs.has.%s}}", n)] = "true"
+	}
+
+	return &clone
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "testing"
+
+func TestCompiledMaxNeedsIterations(t *testing.T) {
+	c := &Compiled{}
+	if got, want := c.maxNeedsIterations(), defaultMaxNeedsIterations; got != want {
+		t.Errorf("default maxNeedsIterations() = %d, want %d", got, want)
+	}
+
+	c.MaxNeedsIterations = 3
+	if got, want := c.maxNeedsIterations(), 3; got != want {
+		t.Errorf("configured maxNeedsIterations() = %d, want %d", got, want)
+	}
+}
+
+func TestHashNeedsIgnoresOrder(t *testing.T) {
+	a := hashNeeds([]string{"foo", "bar"})
+	b := hashNeeds([]string{"bar", "foo"})
+	if a != b {
+		t.Errorf("hashNeeds is order-sensitive: %q != %q", a, b)
+	}
+
+	c := hashNeeds([]string{"bar", "foo", "baz"})
+	if a == c {
+		t.Error("hashNeeds returned the same hash for different needs sets")
+	}
+}
+
+func TestWithNeedsBindsNamespace(t *testing.T) {
+	sm := &SubstitutionMap{Substitutions: map[string]string{"${{package.name}}": "foo"}}
+
+	bound := sm.withNeeds([]string{"bar", "baz"})
+
+	if got, want := bound.Substitutions["${{needs.packages}}"], "bar baz"; got != want {
+		t.Errorf("${{needs.packages}} = %q, want %q", got, want)
+	}
+	if bound.Substitutions["${{needs.has.bar}}"] != "true" {
+		t.Error("${{needs.has.bar}} not bound to true")
+	}
+	if _, ok := bound.Substitutions["${{needs.has.qux}}"]; ok {
+		t.Error("${{needs.has.qux}} should not be bound")
+	}
+
+	// The original SubstitutionMap must be untouched: withNeeds returns a
+	// clone, since CompilePipelines reuses sm across iterations.
+	if _, ok := sm.Substitutions["${{needs.packages}}"]; ok {
+		t.Error("withNeeds mutated the original SubstitutionMap")
+	}
+	if bound.Substitutions["${{package.name}}"] != "foo" {
+		t.Error("withNeeds lost an unrelated existing substitution in its clone")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"chainguard.dev/melange/pkg/config"
+	purl "github.com/package-url/packageurl-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// Progress lets a caller render compilation as it happens: depth is 0
+// for a config's top-level pipelines and increases by one for each
+// level of nested `uses:`/pipeline.Pipeline. Implementations must be
+// safe for concurrent use, since OnPipelineStart/OnPipelineFinish are
+// called from whichever goroutine is compiling that sibling.
+type Progress interface {
+	OnPipelineStart(id string, depth int)
+	OnPipelineFinish(id string, depth int)
+}
+
+type noopProgress struct{}
+
+func (noopProgress) OnPipelineStart(string, int)  {}
+func (noopProgress) OnPipelineFinish(string, int) {}
+
+type (
+	progressContextKey struct{}
+	depthContextKey    struct{}
+)
+
+// WithProgress attaches a Progress to ctx for compilePipeline to report
+// through. Compiling without one (the default) is a no-op.
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, p)
+}
+
+func progressFromContext(ctx context.Context) Progress {
+	if p, ok := ctx.Value(progressContextKey{}).(Progress); ok && p != nil {
+		return p
+	}
+	return noopProgress{}
+}
+
+func withDepth(ctx context.Context, depth int) context.Context {
+	return context.WithValue(ctx, depthContextKey{}, depth)
+}
+
+func depthFromContext(ctx context.Context) int {
+	depth, _ := ctx.Value(depthContextKey{}).(int)
+	return depth
+}
+
+// pipelineConcurrency bounds how many sibling pipelines compileSiblings
+// runs at once: GOMAXPROCS, since compiling a pipeline is a mix of CPU
+// work (substitution, YAML) and blocking I/O (reading pipeline files,
+// and per PipelineResolver, fetching remote ones).
+func pipelineConcurrency() int {
+	if n := runtime.GOMAXPROCS(0); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// compileSiblings compiles pipelines concurrently, bounded by
+// pipelineConcurrency, and returns their combined ExternalRefs in the
+// original order — never the order compilation happened to finish in,
+// so SBOMs and lockfiles stay reproducible across runs. prepare, if
+// non-nil, is called on each pipeline (e.g. to join a parent's `with`
+// into a child's) before it's handed to compilePipeline; it runs
+// sequentially on the calling goroutine, each call just before that
+// pipeline's goroutine is started, so it may overlap with the
+// compilation of earlier siblings. sm is only read during
+// this, never written: SubstitutionMap.Subpackage already returns a
+// clone rather than mutating in place, which is what makes sharing one
+// sm across these goroutines safe.
+func (c *Compiled) compileSiblings(ctx context.Context, sm *SubstitutionMap, pipelines []config.Pipeline, depth int, prepare func(*config.Pipeline)) ([]purl.PackageURL, error) {
+	if len(pipelines) == 0 {
+		return nil, nil
+	}
+
+	ctx = withDepth(ctx, depth)
+	refs := make([][]purl.PackageURL, len(pipelines))
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(pipelineConcurrency())
+
+	for i := range pipelines {
+		i := i
+		p := &pipelines[i]
+		if prepare != nil {
+			prepare(p)
+		}
+
+		g.Go(func() error {
+			r, err := c.compilePipeline(gctx, sm, p)
+			if err != nil {
+				return fmt.Errorf("compiling Pipeline[%d]: %w", i, err)
+			}
+			refs[i] = r
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var out []purl.PackageURL
+	for _, r := range refs {
+		out = append(out, r...)
+	}
+	return out, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type recordingProgress struct {
+	mu      sync.Mutex
+	started []string
+}
+
+func (p *recordingProgress) OnPipelineStart(id string, depth int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = append(p.started, id)
+}
+
+func (p *recordingProgress) OnPipelineFinish(string, int) {}
+
+func TestProgressFromContextDefaultsToNoop(t *testing.T) {
+	// Must be safe to call without panicking even though nothing was
+	// attached via WithProgress.
+	progressFromContext(context.Background()).OnPipelineStart("id", 0)
+	progressFromContext(context.Background()).OnPipelineFinish("id", 0)
+}
+
+func TestWithProgressRoundTrips(t *testing.T) {
+	p := &recordingProgress{}
+	ctx := WithProgress(context.Background(), p)
+
+	got := progressFromContext(ctx)
+	got.OnPipelineStart("fetch", 1)
+
+	if len(p.started) != 1 || p.started[0] != "fetch" {
+		t.Errorf("progressFromContext(ctx) did not return the Progress attached by WithProgress: started=%v", p.started)
+	}
+}
+
+func TestDepthFromContextDefaultsToZero(t *testing.T) {
+	if got := depthFromContext(context.Background()); got != 0 {
+		t.Errorf("depthFromContext on a bare context = %d, want 0", got)
+	}
+}
+
+func TestWithDepthRoundTrips(t *testing.T) {
+	ctx := withDepth(context.Background(), 2)
+	if got := depthFromContext(ctx); got != 2 {
+		t.Errorf("depthFromContext(withDepth(ctx, 2)) = %d, want 2", got)
+	}
+}
+
+func TestPipelineConcurrencyIsAtLeastOne(t *testing.T) {
+	if got := pipelineConcurrency(); got < 1 {
+		t.Errorf("pipelineConcurrency() = %d, want >= 1", got)
+	}
+}
+
+func TestCompileSiblingsEmptyIsNoop(t *testing.T) {
+	c := &Compiled{}
+	refs, err := c.compileSiblings(context.Background(), &SubstitutionMap{Substitutions: map[string]string{}}, nil, 0, nil)
+	if err != nil {
+		t.Fatalf("compileSiblings(nil) returned an error: %v", err)
+	}
+	if refs != nil {
+		t.Errorf("compileSiblings(nil) = %v, want nil", refs)
+	}
+}
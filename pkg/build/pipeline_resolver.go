@@ -0,0 +1,469 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	ocistore "oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// remotePipelineLockFile records the content digest resolved for each
+// remote `uses:` reference (OCI, git, or HTTPS), independent of the
+// semver pinning in pipelineLockFile, so a reference like
+// "oci://ghcr.io/foo/pipelines:v1#fetch" always yields the same bytes
+// across melange runs even if the tag is later moved.
+const remotePipelineLockFile = "melange.pipelines.lock"
+
+// ErrPipelineNotFound is returned by a PipelineResolver when uses isn't a
+// reference it handles, so the chain can fall through to the next one.
+var ErrPipelineNotFound = errors.New("pipeline not found")
+
+// ResolvedRef describes where a PipelineResolver found a `uses:`
+// pipeline. Digest is the content-addressed cache key; PURL is set only
+// for remote resolvers (OCI or git) and is folded into the pipeline's
+// ExternalRefs so SBOMs record exactly what was used.
+type ResolvedRef struct {
+	Digest string
+	PURL   string
+}
+
+// PipelineResolver loads the raw YAML for a `uses:` reference from one
+// kind of source. Build and Test try a chain of resolvers, in order,
+// stopping at the first one that recognizes the reference.
+type PipelineResolver interface {
+	Resolve(ctx context.Context, uses string) ([]byte, ResolvedRef, error)
+}
+
+// resolvers returns the chain of PipelineResolvers tried for a
+// non-versioned `uses:` reference, or c.Resolvers if the caller
+// overrode it.
+func (c *Compiled) resolvers() []PipelineResolver {
+	if c.Resolvers != nil {
+		return c.Resolvers
+	}
+
+	resolvers := make([]PipelineResolver, 0, len(c.PipelineDirs)+4)
+	for _, pd := range c.PipelineDirs {
+		resolvers = append(resolvers, &localDirResolver{dir: pd})
+	}
+
+	return append(resolvers,
+		&embeddedResolver{},
+		&ociResolver{},
+		&gitResolver{},
+		&httpsResolver{},
+	)
+}
+
+// resolveChain tries each resolver in c.resolvers(), in order, caching
+// and locking the result of the first one that handles uses.
+func (c *Compiled) resolveChain(ctx context.Context, uses string) ([]byte, *ResolvedRef, error) {
+	log := clog.FromContext(ctx)
+	lock := pipelineLocksFromContext(ctx).remote
+
+	pinned, havePin := lock.get(uses)
+	if havePin {
+		if data, ok := cacheGet(pinned); ok {
+			log.Debugf("using cached pipeline %q pinned at %s by %s", uses, pinned, remotePipelineLockFile)
+			return data, &ResolvedRef{Digest: pinned}, nil
+		}
+	}
+
+	var errs []error
+	for _, r := range c.resolvers() {
+		data, resolved, err := r.Resolve(ctx, uses)
+		if errors.Is(err, ErrPipelineNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if resolved == (ResolvedRef{}) {
+			// Local and embedded pipelines carry no digest or purl: report
+			// them as not remote, so their external refs are computed as usual.
+			return data, nil, nil
+		}
+
+		if resolved.Digest != "" {
+			// The lockfile pins a ref to one digest; if we have a pin but
+			// the cache was missing it (different machine, cleared cache
+			// dir, ...), a live resolve that now disagrees with the pin
+			// means the ref moved upstream since it was locked - e.g. a
+			// "git+...@main#..." or "oci://...:latest#..." ref. Silently
+			// accepting the new digest would defeat the lockfile's point,
+			// so this is an error rather than a re-pin.
+			if havePin && resolved.Digest != pinned {
+				return nil, nil, fmt.Errorf("pipeline %q is pinned to %s by %s, but resolved to %s: the ref has moved upstream; delete the lock entry to accept the new pin", uses, pinned, remotePipelineLockFile, resolved.Digest)
+			}
+
+			cachePut(resolved.Digest, data)
+			lock.set(uses, resolved.Digest)
+		}
+
+		return data, &resolved, nil
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("resolving pipeline %q: %w", uses, errors.Join(errs...))
+	}
+
+	return nil, nil, fmt.Errorf("could not find 'uses' pipeline %q", uses)
+}
+
+// localDirResolver loads a `uses:` pipeline by exact name from a single
+// PipelineDir.
+type localDirResolver struct {
+	dir string
+}
+
+func (r *localDirResolver) Resolve(ctx context.Context, uses string) ([]byte, ResolvedRef, error) {
+	log := clog.FromContext(ctx)
+	log.Debugf("trying to load pipeline %q from %q", uses, r.dir)
+
+	data, err := os.ReadFile(filepath.Join(r.dir, uses+".yaml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ResolvedRef{}, ErrPipelineNotFound
+		}
+		return nil, ResolvedRef{}, err
+	}
+
+	log.Infof("Found pipeline %s", string(data))
+	return data, ResolvedRef{}, nil
+}
+
+// embeddedResolver loads a `uses:` pipeline by exact name from the
+// pipelines/ tree embedded in the melange binary.
+type embeddedResolver struct{}
+
+func (r *embeddedResolver) Resolve(ctx context.Context, uses string) ([]byte, ResolvedRef, error) {
+	log := clog.FromContext(ctx)
+	log.Debugf("trying to load pipeline %q from embedded fs pipelines/%q.yaml", uses, uses)
+
+	data, err := f.ReadFile("pipelines/" + uses + ".yaml")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ResolvedRef{}, ErrPipelineNotFound
+		}
+		return nil, ResolvedRef{}, err
+	}
+
+	return data, ResolvedRef{}, nil
+}
+
+// httpsResolver loads a `uses:` pipeline from a plain HTTP(S) URL.
+type httpsResolver struct{}
+
+func (r *httpsResolver) Resolve(ctx context.Context, uses string) ([]byte, ResolvedRef, error) {
+	if !strings.HasPrefix(uses, "https://") && !strings.HasPrefix(uses, "http://") {
+		return nil, ResolvedRef{}, ErrPipelineNotFound
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uses, nil)
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("building request for %q: %w", uses, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("fetching %q: %w", uses, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ResolvedRef{}, fmt.Errorf("fetching %q: unexpected status %s", uses, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("reading %q: %w", uses, err)
+	}
+
+	return data, ResolvedRef{Digest: sha256Hex(data)}, nil
+}
+
+// gitResolver loads a `uses:` pipeline out of a git repository, given a
+// reference of the form "git+https://host/org/repo@rev#path/to/pipeline.yaml".
+// rev defaults to HEAD of the default branch if omitted.
+type gitResolver struct{}
+
+func (r *gitResolver) Resolve(ctx context.Context, uses string) ([]byte, ResolvedRef, error) {
+	spec, ok := strings.CutPrefix(uses, "git+")
+	if !ok {
+		return nil, ResolvedRef{}, ErrPipelineNotFound
+	}
+
+	spec, path, ok := strings.Cut(spec, "#")
+	if !ok {
+		return nil, ResolvedRef{}, fmt.Errorf("git pipeline ref %q must be git+<url>[@rev]#<path-in-repo>", uses)
+	}
+
+	url, rev, ok := strings.Cut(spec, "@")
+	if !ok {
+		rev = "HEAD"
+	}
+
+	// url/rev come straight from the (possibly untrusted) uses: string and
+	// are passed as positional arguments to git below. A value starting
+	// with "-" would otherwise be parsed as a git option instead of a
+	// repository/revision - e.g. "--upload-pack=..." - which is a known
+	// git argument-injection RCE vector (cf. CVE-2017-1000117).
+	if strings.HasPrefix(url, "-") {
+		return nil, ResolvedRef{}, fmt.Errorf("git pipeline ref %q: repository URL must not start with '-'", uses)
+	}
+	if strings.HasPrefix(rev, "-") {
+		return nil, ResolvedRef{}, fmt.Errorf("git pipeline ref %q: revision must not start with '-'", uses)
+	}
+
+	dir, err := os.MkdirTemp("", "melange-pipeline-git-*")
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("creating temp clone dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// "--" additionally guards the clone against an option-like url even
+	// if the check above is ever bypassed or loosened; git checkout has
+	// no equivalent safe separator (it would reinterpret rev as a
+	// pathspec instead), so it relies on the validation above alone.
+	if out, err := exec.CommandContext(ctx, "git", "clone", "--quiet", "--", url, dir).CombinedOutput(); err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("cloning %q: %w: %s", url, err, out)
+	}
+
+	if out, err := exec.CommandContext(ctx, "git", "-C", dir, "checkout", "--quiet", rev).CombinedOutput(); err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("checking out %q@%q: %w: %s", url, rev, err, out)
+	}
+
+	commit, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("resolving commit for %q@%q: %w", url, rev, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, path))
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("reading %q from %q: %w", path, url, err)
+	}
+
+	sha := strings.TrimSpace(string(commit))
+
+	return data, ResolvedRef{
+		Digest: sha256Hex(data),
+		PURL:   fmt.Sprintf("pkg:github/%s@%s#%s", githubSlug(url), sha, path),
+	}, nil
+}
+
+// githubSlug extracts "org/repo" from a github.com URL, falling back to
+// the full URL (with the scheme stripped) for other git hosts.
+func githubSlug(url string) string {
+	for _, prefix := range []string{"https://github.com/", "http://github.com/", "git@github.com:"} {
+		if rest, ok := strings.CutPrefix(url, prefix); ok {
+			return strings.TrimSuffix(rest, ".git")
+		}
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://"), ".git")
+}
+
+// ociResolver loads a `uses:` pipeline out of an OCI artifact, given a
+// reference of the form "oci://registry/repo:tag#path/to/pipeline.yaml".
+type ociResolver struct{}
+
+func (r *ociResolver) Resolve(ctx context.Context, uses string) ([]byte, ResolvedRef, error) {
+	loc, ok := strings.CutPrefix(uses, "oci://")
+	if !ok {
+		return nil, ResolvedRef{}, ErrPipelineNotFound
+	}
+
+	ref, path, ok := strings.Cut(loc, "#")
+	if !ok {
+		return nil, ResolvedRef{}, fmt.Errorf("oci pipeline ref %q must be oci://<image-ref>#<path-in-bundle>", uses)
+	}
+
+	tmp, err := os.MkdirTemp("", "melange-pipeline-oci-*")
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("creating temp OCI store: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst, err := ocistore.New(tmp)
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("creating OCI store: %w", err)
+	}
+
+	repo, err := remote.NewRepository(ref)
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("parsing OCI reference %q: %w", ref, err)
+	}
+
+	desc, err := oras.Copy(ctx, repo, repo.Reference.Reference, dst, repo.Reference.Reference, oras.DefaultCopyOptions)
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("pulling OCI pipeline bundle %q: %w", ref, err)
+	}
+
+	data, err := extractFromOCIBundle(ctx, dst, desc, path)
+	if err != nil {
+		return nil, ResolvedRef{}, fmt.Errorf("extracting %q from OCI pipeline bundle %q: %w", path, ref, err)
+	}
+
+	return data, ResolvedRef{
+		Digest: sha256Hex(data),
+		PURL:   fmt.Sprintf("pkg:oci/%s@%s?path=%s", repo.Reference.Repository, desc.Digest.String(), path),
+	}, nil
+}
+
+// extractFromOCIBundle walks the layers of an OCI image manifest looking
+// for path inside each layer's tarball, returning the first match.
+func extractFromOCIBundle(ctx context.Context, store content.Storage, desc ocispec.Descriptor, path string) ([]byte, error) {
+	manifestRC, err := store.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest: %w", err)
+	}
+	defer manifestRC.Close()
+
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(manifestRC).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		data, ok, err := fetchTarEntry(ctx, store, layer, path)
+		if err != nil {
+			return nil, fmt.Errorf("reading layer %s: %w", layer.Digest, err)
+		}
+		if ok {
+			return data, nil
+		}
+	}
+
+	return nil, fmt.Errorf("path %q not found in any layer", path)
+}
+
+func fetchTarEntry(ctx context.Context, store content.Storage, layer ocispec.Descriptor, path string) ([]byte, bool, error) {
+	rc, err := store.Fetch(ctx, layer)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+
+	r := io.Reader(rc)
+	if gr, err := gzip.NewReader(r); err == nil {
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("reading tar entry: %w", err)
+		}
+
+		if strings.TrimPrefix(hdr.Name, "./") != path {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, false, fmt.Errorf("reading %q: %w", path, err)
+		}
+		return data, true, nil
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// pipelineCacheDir is the content-addressed cache for remote pipelines,
+// keyed by the sha256 of their resolved bytes.
+func pipelineCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "melange", "pipelines")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".cache", "melange", "pipelines")
+	}
+	return filepath.Join(os.TempDir(), "melange", "pipelines")
+}
+
+// cacheGet returns the cached bytes for digest, verifying they still hash
+// to it: compileSiblings (see chunk0-5) resolves siblings concurrently, so
+// a get can race a put for the same digest from another goroutine, and the
+// hash check rejects a partial/in-progress write rather than handing back
+// truncated pipeline YAML.
+func cacheGet(digest string) ([]byte, bool) {
+	data, err := os.ReadFile(filepath.Join(pipelineCacheDir(), digest))
+	if err != nil {
+		return nil, false
+	}
+	if sha256Hex(data) != digest {
+		return nil, false
+	}
+	return data, true
+}
+
+// cachePut writes data to the content-addressed cache under digest. It
+// writes to a temp file in the same directory and renames it into place,
+// so a concurrent cacheGet for the same digest (two siblings resolving
+// the same remote uses: at once) either sees the old file or the
+// complete new one, never a partial write.
+func cachePut(digest string, data []byte) {
+	dir := pipelineCacheDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, digest+".tmp-*")
+	if err != nil {
+		// Best-effort: a failed cache write just means the next run
+		// re-resolves this pipeline instead of hitting the cache.
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+
+	_ = os.Rename(tmp.Name(), filepath.Join(dir, digest))
+}
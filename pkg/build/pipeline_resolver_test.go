@@ -0,0 +1,121 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachePutCacheGetRoundTrips(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	data := []byte("pipeline: contents")
+	digest := sha256Hex(data)
+
+	cachePut(digest, data)
+
+	got, ok := cacheGet(digest)
+	if !ok {
+		t.Fatal("cacheGet missed immediately after cachePut")
+	}
+	if string(got) != string(data) {
+		t.Errorf("cacheGet = %q, want %q", got, data)
+	}
+}
+
+func TestCacheGetRejectsCorruptedEntry(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	data := []byte("pipeline: contents")
+	digest := sha256Hex(data)
+
+	cachePut(digest, data)
+
+	// Corrupt the cached file in place, as a truncated concurrent write
+	// might leave it: cacheGet must not hand back mismatched bytes for
+	// the digest it was asked for.
+	path := filepath.Join(pipelineCacheDir(), digest)
+	if err := os.WriteFile(path, []byte("truncat"), 0o644); err != nil {
+		t.Fatalf("corrupting cache entry: %v", err)
+	}
+
+	if _, ok := cacheGet(digest); ok {
+		t.Error("cacheGet returned a cache entry whose contents don't hash to its digest")
+	}
+}
+
+// fakeResolver is a PipelineResolver stub for exercising resolveChain
+// without a real OCI/git/HTTPS fetch.
+type fakeResolver struct {
+	data     []byte
+	resolved ResolvedRef
+}
+
+func (r fakeResolver) Resolve(context.Context, string) ([]byte, ResolvedRef, error) {
+	return r.data, r.resolved, nil
+}
+
+func TestResolveChainErrorsOnLockDrift(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	ctx, locks := withPipelineLocks(context.Background())
+	locks.remote.set("oci://example/pipelines:latest#fetch.yaml", "oldDigest")
+
+	c := &Compiled{Resolvers: []PipelineResolver{
+		fakeResolver{data: []byte("new contents"), resolved: ResolvedRef{Digest: "newDigest", PURL: "pkg:oci/example/pipelines@newDigest?path=fetch.yaml"}},
+	}}
+
+	_, _, err := c.resolveChain(ctx, "oci://example/pipelines:latest#fetch.yaml")
+	if err == nil {
+		t.Fatal("resolveChain silently re-pinned a ref that resolved to a different digest than the lock, want an error")
+	}
+}
+
+func TestResolveChainPinsNewRef(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	ctx, locks := withPipelineLocks(context.Background())
+
+	c := &Compiled{Resolvers: []PipelineResolver{
+		fakeResolver{data: []byte("contents"), resolved: ResolvedRef{Digest: sha256Hex([]byte("contents")), PURL: "pkg:oci/example/pipelines@abc?path=fetch.yaml"}},
+	}}
+
+	data, resolved, err := c.resolveChain(ctx, "oci://example/pipelines:v1#fetch.yaml")
+	if err != nil {
+		t.Fatalf("resolveChain returned an error for a fresh ref: %v", err)
+	}
+	if string(data) != "contents" {
+		t.Errorf("resolveChain data = %q, want %q", data, "contents")
+	}
+
+	if got, ok := locks.remote.get("oci://example/pipelines:v1#fetch.yaml"); !ok || got != resolved.Digest {
+		t.Errorf("resolveChain did not pin the resolved digest into the lock: got %q, ok=%v", got, ok)
+	}
+}
+
+func TestGitResolverRejectsOptionLikeURLAndRev(t *testing.T) {
+	r := &gitResolver{}
+
+	if _, _, err := r.Resolve(context.Background(), "git+--upload-pack=touch$IFS/tmp/pwned;#x.yaml"); err == nil {
+		t.Error("gitResolver accepted a url starting with '-', want an error")
+	}
+
+	if _, _, err := r.Resolve(context.Background(), "git+https://example.com/foo/bar@--upload-pack=evil#x.yaml"); err == nil {
+		t.Error("gitResolver accepted a rev starting with '-', want an error")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/chainguard-dev/clog"
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineLockFile is the name of the file melange uses to pin the
+// versions it resolved for constrained `uses:` references, so that
+// rebuilds are hermetic even as new pipeline versions are published.
+const pipelineLockFile = "melange.lock.yaml"
+
+// usesRef is a parsed `uses:` value, e.g. "go/build@>=0.3,<0.5" splits
+// into name "go/build" and constraint ">=0.3,<0.5". A ref with no "@" is
+// unversioned and resolved by exact match, as before.
+type usesRef struct {
+	Name       string
+	Constraint string
+}
+
+// remoteUsesPrefixes are the `uses:` schemes handled by a remote
+// PipelineResolver (see resolveChain) rather than by semver constraint
+// matching. They all use "@" for their own purposes - a git revision
+// (git+https://host/org/repo@rev#path) or an OCI digest pin
+// (oci://registry/repo@sha256:...#path) - so parseUsesRef must not treat
+// them as "name@constraint" the way it does a local/embedded uses.
+var remoteUsesPrefixes = []string{"oci://", "git+", "https://", "http://"}
+
+func parseUsesRef(uses string) usesRef {
+	for _, prefix := range remoteUsesPrefixes {
+		if strings.HasPrefix(uses, prefix) {
+			return usesRef{Name: uses}
+		}
+	}
+
+	name, constraint, ok := strings.Cut(uses, "@")
+	if !ok {
+		return usesRef{Name: uses}
+	}
+	return usesRef{Name: name, Constraint: constraint}
+}
+
+func (r usesRef) versioned() bool {
+	return r.Constraint != ""
+}
+
+// refForExternalRefs returns the `uses:` value that should be fed to
+// computeExternalRefs. A semver-constrained uses is stripped to its bare
+// name first, so the constraint isn't mistaken for part of the package
+// name/namespace that computeExternalRefs derives the purl from; anything
+// else (including a plain, unversioned uses) passes through unchanged.
+func refForExternalRefs(uses, resolvedVersion string) string {
+	if resolvedVersion == "" {
+		return uses
+	}
+	return parseUsesRef(uses).Name
+}
+
+// versionedPipeline is a single candidate version of a `uses:` pipeline,
+// discovered either under a sibling versions/ subtree or from a
+// `version:` field declared inside the pipeline YAML itself.
+type versionedPipeline struct {
+	Version *semver.Version
+	Data    []byte
+}
+
+// resolvePipeline loads the YAML for a `uses:` reference, returning the
+// raw pipeline bytes plus, respectively: the resolved version string for
+// a semver-constrained reference, and the ResolvedRef for a reference
+// satisfied by a remote PipelineResolver. At most one of the two is set;
+// unconstrained local/embedded references return neither.
+func (c *Compiled) resolvePipeline(ctx context.Context, uses string) ([]byte, string, *ResolvedRef, error) {
+	ref := parseUsesRef(uses)
+	if !ref.versioned() {
+		data, resolved, err := c.resolveChain(ctx, uses)
+		return data, "", resolved, err
+	}
+
+	data, version, err := c.resolveVersioned(ctx, uses, ref)
+	return data, version, nil, err
+}
+
+// resolveVersioned resolves a semver-constrained `uses:` reference by
+// discovering every version of ref.Name available across the local
+// PipelineDirs and the embedded pipelines/ tree, then picking the
+// highest one satisfying ref.Constraint. Remote PipelineResolvers don't
+// participate: versions/ subtrees and in-file `version:` fields are a
+// local/embedded convention.
+func (c *Compiled) resolveVersioned(ctx context.Context, uses string, ref usesRef) ([]byte, string, error) {
+	constraint, err := semver.NewConstraint(ref.Constraint)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing version constraint %q for pipeline %q: %w", ref.Constraint, ref.Name, err)
+	}
+
+	log := clog.FromContext(ctx)
+	lock := pipelineLocksFromContext(ctx).version
+
+	roots := c.pipelineRoots()
+
+	if pinned, ok := lock.get(uses); ok {
+		if v, err := semver.NewVersion(pinned); err == nil && constraint.Check(v) {
+			if data, ok := findPinnedVersion(roots, ref.Name, v); ok {
+				log.Debugf("using pipeline %q pinned at %s by %s", ref.Name, pinned, pipelineLockFile)
+				return data, pinned, nil
+			}
+		}
+	}
+
+	var best *versionedPipeline
+	for _, root := range roots {
+		candidates, err := discoverPipelineVersions(root, ref.Name)
+		if err != nil {
+			return nil, "", fmt.Errorf("discovering versions of pipeline %q: %w", ref.Name, err)
+		}
+
+		for i := range candidates {
+			cand := candidates[i]
+			if !constraint.Check(cand.Version) {
+				continue
+			}
+			if best == nil || cand.Version.GreaterThan(best.Version) {
+				best = &cand
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, "", fmt.Errorf("no version of pipeline %q satisfies %q", ref.Name, ref.Constraint)
+	}
+
+	log.Infof("resolved pipeline %q@%s to version %s", ref.Name, ref.Constraint, best.Version)
+	lock.set(uses, best.Version.String())
+
+	return best.Data, best.Version.String(), nil
+}
+
+// pipelineRoots returns the local filesystems searched when discovering
+// versions of a semver-constrained `uses:` reference: each PipelineDir
+// in order, then the embedded pipelines/ tree.
+func (c *Compiled) pipelineRoots() []fs.FS {
+	roots := make([]fs.FS, 0, len(c.PipelineDirs)+1)
+	for _, pd := range c.PipelineDirs {
+		roots = append(roots, os.DirFS(pd))
+	}
+
+	embedded, err := fs.Sub(f, "pipelines")
+	if err == nil {
+		roots = append(roots, embedded)
+	}
+
+	return roots
+}
+
+// discoverPipelineVersions finds every version of the named pipeline
+// available under root, either as "<name>/versions/<semver>.yaml" or as
+// a `version:` field declared inside a bare "<name>.yaml".
+func discoverPipelineVersions(root fs.FS, name string) ([]versionedPipeline, error) {
+	var out []versionedPipeline
+
+	entries, err := fs.ReadDir(root, path.Join(name, "versions"))
+	switch {
+	case err == nil:
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".yaml") {
+				continue
+			}
+
+			v, err := semver.NewVersion(strings.TrimSuffix(e.Name(), ".yaml"))
+			if err != nil {
+				continue
+			}
+
+			data, err := fs.ReadFile(root, path.Join(name, "versions", e.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, versionedPipeline{Version: v, Data: data})
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	if data, err := fs.ReadFile(root, name+".yaml"); err == nil {
+		var meta struct {
+			Version string `yaml:"version"`
+		}
+		if err := yaml.Unmarshal(data, &meta); err == nil && meta.Version != "" {
+			if v, err := semver.NewVersion(meta.Version); err == nil {
+				out = append(out, versionedPipeline{Version: v, Data: data})
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// findPinnedVersion looks for the exact version v of pipeline name
+// across roots, in order, returning its data if found.
+func findPinnedVersion(roots []fs.FS, name string, v *semver.Version) ([]byte, bool) {
+	for _, root := range roots {
+		candidates, err := discoverPipelineVersions(root, name)
+		if err != nil {
+			continue
+		}
+		for _, cand := range candidates {
+			if cand.Version.Equal(v) {
+				return cand.Data, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// diskLock is a small, thread-safe string->string map mirrored to a YAML
+// file on disk, used to pin resolution results (a semver-constrained
+// `uses:` version, or a remote pipeline's content digest) across
+// melange runs so rebuilds stay hermetic.
+type diskLock struct {
+	mu sync.Mutex
+
+	Entries map[string]string `yaml:"entries"`
+
+	dirty bool
+}
+
+func loadDiskLock(file string) *diskLock {
+	l := &diskLock{Entries: map[string]string{}}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		// No lockfile yet, or unreadable: resolve from scratch.
+		return l
+	}
+
+	// A malformed lockfile is treated the same as a missing one.
+	_ = yaml.Unmarshal(data, l)
+	if l.Entries == nil {
+		l.Entries = map[string]string{}
+	}
+
+	return l
+}
+
+func (l *diskLock) get(key string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v, ok := l.Entries[key]
+	return v, ok
+}
+
+func (l *diskLock) set(key, value string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Entries[key] == value {
+		return
+	}
+	l.Entries[key] = value
+	l.dirty = true
+}
+
+func (l *diskLock) save(file string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("marshaling %s: %w", file, err)
+	}
+
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", file, err)
+	}
+
+	l.dirty = false
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "testing"
+
+func TestParseUsesRef(t *testing.T) {
+	tests := []struct {
+		name           string
+		uses           string
+		wantName       string
+		wantConstraint string
+	}{
+		{
+			name:     "unversioned local ref",
+			uses:     "fetch",
+			wantName: "fetch",
+		},
+		{
+			name:           "semver constrained local ref",
+			uses:           "fetch@^1.2.0",
+			wantName:       "fetch",
+			wantConstraint: "^1.2.0",
+		},
+		{
+			name:     "git ref with a pinned revision",
+			uses:     "git+https://github.com/foo/bar@v1.2.3#fetch.yaml",
+			wantName: "git+https://github.com/foo/bar@v1.2.3#fetch.yaml",
+		},
+		{
+			name:     "oci ref with a digest pin",
+			uses:     "oci://ghcr.io/foo/pipelines@sha256:deadbeef#fetch.yaml",
+			wantName: "oci://ghcr.io/foo/pipelines@sha256:deadbeef#fetch.yaml",
+		},
+		{
+			name:     "plain https ref",
+			uses:     "https://example.com/pipelines/fetch.yaml",
+			wantName: "https://example.com/pipelines/fetch.yaml",
+		},
+		{
+			name:     "http ref with an '@' in the path",
+			uses:     "http://example.com/fetch@latest.yaml",
+			wantName: "http://example.com/fetch@latest.yaml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseUsesRef(tt.uses)
+			if got.Name != tt.wantName || got.Constraint != tt.wantConstraint {
+				t.Errorf("parseUsesRef(%q) = %+v, want {Name:%q Constraint:%q}", tt.uses, got, tt.wantName, tt.wantConstraint)
+			}
+		})
+	}
+}
+
+func TestRefForExternalRefs(t *testing.T) {
+	if got, want := refForExternalRefs("fetch@^1.2.0", "1.4.0"), "fetch"; got != want {
+		t.Errorf("refForExternalRefs(versioned) = %q, want %q", got, want)
+	}
+	if got, want := refForExternalRefs("fetch", ""), "fetch"; got != want {
+		t.Errorf("refForExternalRefs(unversioned) = %q, want %q", got, want)
+	}
+}
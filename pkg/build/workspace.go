@@ -0,0 +1,149 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	purl "github.com/package-url/packageurl-go"
+	"gopkg.in/yaml.v3"
+)
+
+// WorkspaceConfig is the shape of melange.work.yaml: the member configs,
+// by directory relative to the workspace root, that make up a
+// workspace.
+type WorkspaceConfig struct {
+	Members []string `yaml:"members"`
+}
+
+// LoadWorkspaceConfig reads and parses a melange.work.yaml at path.
+func LoadWorkspaceConfig(path string) (*WorkspaceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading workspace config %q: %w", path, err)
+	}
+
+	var wc WorkspaceConfig
+	if err := yaml.Unmarshal(data, &wc); err != nil {
+		return nil, fmt.Errorf("parsing workspace config %q: %w", path, err)
+	}
+
+	return &wc, nil
+}
+
+// Workspace compiles several related Build configurations together, the
+// way Go's MainModules compiles every module in a workspace against a
+// shared build list. Each member keeps its own SubstitutionMap, but all
+// of them see a `workspace.*` namespace so they can reference each
+// other, and Compile attaches one shared set of pipeline lockfiles (see
+// withPipelineLocks) to the context before compiling any member, so they
+// resolve against - and pin into - the same lock state instead of each
+// loading and saving its own.
+type Workspace struct {
+	// Root is the workspace root directory, the directory containing
+	// melange.work.yaml. Exposed to members as ${{workspace.root}}.
+	Root string
+
+	// Members are the Build targets participating in the workspace, in
+	// melange.work.yaml order.
+	Members []*Build
+
+	// ExternalRefs is the union of every member's ExternalRefs, set once
+	// Compile succeeds.
+	ExternalRefs []purl.PackageURL
+}
+
+// NewWorkspace builds a Workspace from already-constructed member
+// Builds (loading melange.yaml for each member, given a WorkspaceConfig,
+// is left to the caller, the same way loading a single Build's
+// configuration is).
+func NewWorkspace(root string, members []*Build) *Workspace {
+	return &Workspace{Root: root, Members: members}
+}
+
+// Compile compiles every member of the workspace. Subpackage names are
+// deduplicated across all members up front: two members producing a
+// subpackage with the same name is always a configuration error, and
+// we'd rather fail here than at apk-build time. Each member is then
+// compiled with a `workspace.*` substitution namespace layered on top of
+// its own, and the members' ExternalRefs are merged onto the workspace
+// for a single cross-package SBOM.
+func (w *Workspace) Compile(ctx context.Context) error {
+	if err := w.checkDuplicateSubpackages(); err != nil {
+		return err
+	}
+
+	ctx, locks := withPipelineLocks(ctx)
+
+	members := make(map[string]*Build, len(w.Members))
+	for _, m := range w.Members {
+		members[m.Configuration.Package.Name] = m
+	}
+
+	extra := workspaceSubstitutions(w.Root, members)
+
+	for _, m := range w.Members {
+		if err := m.compile(ctx, extra); err != nil {
+			return fmt.Errorf("compiling workspace member %q: %w", m.Configuration.Package.Name, err)
+		}
+
+		w.ExternalRefs = append(w.ExternalRefs, m.externalRefs...)
+	}
+
+	return locks.save()
+}
+
+// checkDuplicateSubpackages errors if two members of the workspace would
+// produce packages (main or subpackages) sharing the same name.
+func (w *Workspace) checkDuplicateSubpackages() error {
+	owner := map[string]string{}
+
+	for _, m := range w.Members {
+		root := m.Configuration.Package.Name
+
+		names := make([]string, 0, len(m.Configuration.Subpackages)+1)
+		names = append(names, root)
+		for _, sp := range m.Configuration.Subpackages {
+			names = append(names, sp.Name)
+		}
+
+		for _, name := range names {
+			if other, ok := owner[name]; ok {
+				return fmt.Errorf("workspace members %q and %q both produce a package named %q", other, root, name)
+			}
+			owner[name] = root
+		}
+	}
+
+	return nil
+}
+
+// workspaceSubstitutions returns the ${{workspace.*}} bindings available
+// to every member while compiling: ${{workspace.root}} is the workspace
+// root directory, and ${{workspace.member.<name>.version}} lets one
+// member's `depends:` reference another's version.
+func workspaceSubstitutions(root string, members map[string]*Build) map[string]string {
+	subs := map[string]string{
+		"${{workspace.root}}": root,
+	}
+
+	for name, m := range members {
+		subs[fmt.Sprintf("${{workspace.member.%s.version}}", name)] = m.Configuration.Package.Version
+	}
+
+	return subs
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func memberBuild(pkgName string, subpackageNames ...string) *Build {
+	cfg := config.Configuration{
+		Package: config.Package{Name: pkgName},
+	}
+	for _, name := range subpackageNames {
+		cfg.Subpackages = append(cfg.Subpackages, config.Subpackage{Name: name})
+	}
+	return &Build{Configuration: cfg}
+}
+
+func TestWorkspaceCheckDuplicateSubpackagesOK(t *testing.T) {
+	w := &Workspace{Members: []*Build{
+		memberBuild("foo", "foo-doc"),
+		memberBuild("bar", "bar-doc"),
+	}}
+
+	if err := w.checkDuplicateSubpackages(); err != nil {
+		t.Errorf("unexpected error for disjoint package names: %v", err)
+	}
+}
+
+func TestWorkspaceCheckDuplicateSubpackagesCollision(t *testing.T) {
+	w := &Workspace{Members: []*Build{
+		memberBuild("foo", "shared"),
+		memberBuild("bar", "shared"),
+	}}
+
+	if err := w.checkDuplicateSubpackages(); err == nil {
+		t.Error("expected an error for two members producing a subpackage named \"shared\", got nil")
+	}
+}
+
+func TestWorkspaceCheckDuplicateSubpackagesRootVsSubpackage(t *testing.T) {
+	w := &Workspace{Members: []*Build{
+		memberBuild("foo"),
+		memberBuild("bar", "foo"),
+	}}
+
+	if err := w.checkDuplicateSubpackages(); err == nil {
+		t.Error("expected an error when one member's root package name collides with another's subpackage, got nil")
+	}
+}
+
+func TestWorkspaceSubstitutions(t *testing.T) {
+	cfg := config.Configuration{Package: config.Package{Name: "foo", Version: "1.2.3"}}
+	members := map[string]*Build{"foo": {Configuration: cfg}}
+
+	subs := workspaceSubstitutions("/work/root", members)
+
+	if got, want := subs["${{workspace.root}}"], "/work/root"; got != want {
+		t.Errorf("${{workspace.root}} = %q, want %q", got, want)
+	}
+	if got, want := subs["${{workspace.member.foo.version}}"], "1.2.3"; got != want {
+		t.Errorf("${{workspace.member.foo.version}} = %q, want %q", got, want)
+	}
+}